@@ -0,0 +1,242 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/trace"
+)
+
+// githubAuthTokenURL is GitHub's OAuth2 code-for-token exchange endpoint
+const githubAuthTokenURL = "https://github.com/login/oauth/access_token"
+
+// githubAPIBaseURL is the root of the GitHub REST API this handler calls
+// into to resolve the authenticated user's identity and org/team membership
+const githubAPIBaseURL = "https://api.github.com"
+
+// GithubAuthService turns the OAuth2 connector/auth-request storage on
+// IdentityService into a working GitHub SSO login: it exchanges the
+// authorization code, resolves the user's verified primary email and
+// org/team membership, enforces the connector's allow-list, and maps the
+// result to a Teleport user the same way OIDC logins do.
+type GithubAuthService struct {
+	identity *IdentityService
+	client   *http.Client
+}
+
+// NewGithubAuthService returns a GithubAuthService built on top of identity.
+// client may be nil, in which case http.DefaultClient is used.
+func NewGithubAuthService(identity *IdentityService, client *http.Client) *GithubAuthService {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &GithubAuthService{identity: identity, client: client}
+}
+
+// githubUser is the subset of GitHub's GET /user response this handler needs
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+// githubEmail is one entry of GitHub's GET /user/emails response
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// githubOrg is one entry of GitHub's GET /user/orgs response
+type githubOrg struct {
+	Login string `json:"login"`
+}
+
+// githubTeam is one entry of GitHub's GET /user/teams response
+type githubTeam struct {
+	Slug string `json:"slug"`
+	Org  struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
+// ExchangeCode completes a GitHub OAuth2 login: it exchanges code for an
+// access token, verifies state against the auth request created by
+// CreateOAuth2AuthRequest, fetches the GitHub identity behind the token,
+// enforces connector's org/team allow-list, and returns the Teleport user
+// mapped to that identity.
+func (s *GithubAuthService) ExchangeCode(connector services.OAuth2Connector, state, code string) (services.User, error) {
+	req, err := s.identity.GetOAuth2AuthRequest(connector.Type, state)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if req.StateToken != state {
+		return nil, trace.AccessDenied("OAuth2 state token does not match the outstanding auth request")
+	}
+
+	accessToken, err := s.exchangeCode(connector, code)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	ghUser, err := s.fetchUser(accessToken)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if _, err := s.fetchVerifiedPrimaryEmail(accessToken); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := s.enforceAllowList(connector, accessToken); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	identity := services.ExternalIdentity{
+		Provider: connector.Type,
+		Username: ghUser.Login,
+	}
+	return s.identity.GetUserByExternalIdentity(identity)
+}
+
+// exchangeCode trades an OAuth2 authorization code for an access token
+func (s *GithubAuthService) exchangeCode(connector services.OAuth2Connector, code string) (string, error) {
+	form := url.Values{
+		"client_id":     []string{connector.ClientID},
+		"client_secret": []string{connector.ClientSecret},
+		"code":          []string{code},
+	}
+	httpReq, err := http.NewRequest("POST", githubAuthTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		ErrorDesc   string `json:"error_description"`
+	}
+	if err := s.doJSON(httpReq, &out); err != nil {
+		return "", trace.Wrap(err)
+	}
+	if out.Error != "" {
+		return "", trace.AccessDenied("github rejected the OAuth2 code exchange: %v: %v", out.Error, out.ErrorDesc)
+	}
+	if out.AccessToken == "" {
+		return "", trace.AccessDenied("github OAuth2 code exchange returned no access token")
+	}
+	return out.AccessToken, nil
+}
+
+// fetchUser calls GET /user to resolve the GitHub login behind accessToken
+func (s *GithubAuthService) fetchUser(accessToken string) (*githubUser, error) {
+	var user githubUser
+	if err := s.getGithubAPI(accessToken, "/user", &user); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &user, nil
+}
+
+// fetchVerifiedPrimaryEmail calls GET /user/emails and returns the user's
+// verified primary address, refusing to authenticate a user whose primary
+// email GitHub hasn't verified
+func (s *GithubAuthService) fetchVerifiedPrimaryEmail(accessToken string) (string, error) {
+	var emails []githubEmail
+	if err := s.getGithubAPI(accessToken, "/user/emails", &emails); err != nil {
+		return "", trace.Wrap(err)
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", trace.AccessDenied("github account has no verified primary email")
+}
+
+// enforceAllowList checks the authenticated user's org and team membership,
+// fetched via /user/orgs and /user/teams, against connector's allow-list. A
+// connector with no entries in its allow-list admits nobody: forgetting to
+// configure teams must not silently open the cluster to every GitHub user.
+func (s *GithubAuthService) enforceAllowList(connector services.OAuth2Connector, accessToken string) error {
+	if len(connector.TeamsToLogins) == 0 {
+		return trace.AccessDenied("github connector %q has no org/team allow-list configured, denying all logins", connector.ID)
+	}
+	var orgs []githubOrg
+	if err := s.getGithubAPI(accessToken, "/user/orgs", &orgs); err != nil {
+		return trace.Wrap(err)
+	}
+	memberOrgs := make(map[string]bool, len(orgs))
+	for _, o := range orgs {
+		memberOrgs[o.Login] = true
+	}
+
+	var teams []githubTeam
+	if err := s.getGithubAPI(accessToken, "/user/teams", &teams); err != nil {
+		return trace.Wrap(err)
+	}
+	memberTeams := make(map[string]bool, len(teams))
+	for _, t := range teams {
+		memberTeams[t.Org.Login+"/"+t.Slug] = true
+	}
+
+	for _, mapping := range connector.TeamsToLogins {
+		if mapping.Team == "" {
+			if memberOrgs[mapping.Organization] {
+				return nil
+			}
+			continue
+		}
+		if memberTeams[mapping.Organization+"/"+mapping.Team] {
+			return nil
+		}
+	}
+	return trace.AccessDenied("github user is not a member of any org/team allowed by this connector")
+}
+
+// getGithubAPI issues an authenticated GET against the GitHub API and
+// decodes the JSON response into out
+func (s *GithubAuthService) getGithubAPI(accessToken, path string, out interface{}) error {
+	httpReq, err := http.NewRequest("GET", githubAPIBaseURL+path, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	httpReq.Header.Set("Authorization", "token "+accessToken)
+	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
+	return trace.Wrap(s.doJSON(httpReq, out))
+}
+
+// doJSON executes httpReq and decodes a JSON response body into out
+func (s *GithubAuthService) doJSON(httpReq *http.Request, out interface{}) error {
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return trace.AccessDenied("github API request to %v returned status %v", httpReq.URL.Path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return trace.Wrap(fmt.Errorf("failed to decode github API response: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/trace"
+)
+
+// maxLimiterCASRetries bounds how many times RecordFailure will retry
+// a CompareAndSwap race against a concurrent update to the same bucket
+// before giving up.
+const maxLimiterCASRetries = 16
+
+// loginLimiterPath returns the backend bucket holding per-IP bucket state
+// for a given user's failed logins
+func loginLimiterPath(user string) []string {
+	return []string{"web", "loginlimits", user}
+}
+
+// loginBucketState is the token-bucket and rolling failure window persisted
+// per (user, sourceIP) pair
+type loginBucketState struct {
+	// Tokens is the number of login attempts currently available
+	Tokens float64 `json:"tokens"`
+	// LastRefill is the last time Tokens was topped up
+	LastRefill time.Time `json:"last_refill"`
+	// Failures holds the timestamps of recent failed attempts, used to
+	// compute exponential backoff. Entries older than lockDuration are
+	// dropped from Allow's in-memory copy before computing backoff; the
+	// stored list is not pruned.
+	Failures []time.Time `json:"failures"`
+}
+
+// LoginAttemptLimitError is returned by LoginLimiter.Allow (and bubbled up
+// through CheckPassword/CheckPasswordWOToken) when the caller must wait
+// before attempting another login.
+type LoginAttemptLimitError struct {
+	// RetryAfter is how long the caller should wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *LoginAttemptLimitError) Error() string {
+	return fmt.Sprintf("too many login attempts, retry after %v", e.RetryAfter)
+}
+
+// LoginLimiter is a token-bucket rate limiter with exponential backoff,
+// keyed by (user, sourceIP). Each failed login consumes a token; tokens
+// refill at a constant rate, and on top of that, attempts are spaced out by
+// 1s, 2s, 4s, ... between failures, capped at lockDuration.
+type LoginLimiter struct {
+	backend backend.Backend
+	// burst is the bucket capacity, i.e. how many failures are allowed
+	// before tokens run out
+	burst int
+	// refillPerSec is how many tokens are added back per second
+	refillPerSec float64
+	// lockDuration caps both the backoff delay and the TTL of bucket state
+	lockDuration time.Duration
+}
+
+// Allow reports whether user may attempt another login from sourceIP right
+// now. If not, it returns the duration the caller should wait before
+// retrying along with a *LoginAttemptLimitError.
+func (l *LoginLimiter) Allow(user, sourceIP string) (time.Duration, error) {
+	data, _, err := l.backend.GetValAndTTL(loginLimiterPath(user), sourceIP)
+	if err != nil {
+		if trace.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, trace.Wrap(err)
+	}
+	var state loginBucketState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, trace.Wrap(err)
+	}
+	l.refill(&state)
+	if wait := l.backoff(&state); wait > 0 {
+		return wait, &LoginAttemptLimitError{RetryAfter: wait}
+	}
+	if state.Tokens < 1 {
+		return l.lockDuration, &LoginAttemptLimitError{RetryAfter: l.lockDuration}
+	}
+	return 0, nil
+}
+
+// RecordFailure consumes a token and records a failed login attempt for
+// (user, sourceIP), pushing out the exponential backoff before the next
+// attempt is allowed.
+func (l *LoginLimiter) RecordFailure(user, sourceIP string) error {
+	return l.updateState(user, sourceIP, func(s *loginBucketState) {
+		if s.Tokens > 0 {
+			s.Tokens--
+		}
+		s.Failures = append(s.Failures, time.Now().UTC())
+	})
+}
+
+// RecordSuccess clears the bucket state for (user, sourceIP) following a
+// successful login.
+func (l *LoginLimiter) RecordSuccess(user, sourceIP string) error {
+	err := l.backend.DeleteKey(loginLimiterPath(user), sourceIP)
+	if trace.IsNotFound(err) {
+		return nil
+	}
+	return trace.Wrap(err)
+}
+
+// refill tops Tokens up based on how long it's been since LastRefill
+func (l *LoginLimiter) refill(s *loginBucketState) {
+	now := time.Now().UTC()
+	if s.LastRefill.IsZero() {
+		s.Tokens = float64(l.burst)
+		s.LastRefill = now
+		return
+	}
+	elapsed := now.Sub(s.LastRefill).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	s.Tokens += elapsed * l.refillPerSec
+	if s.Tokens > float64(l.burst) {
+		s.Tokens = float64(l.burst)
+	}
+	s.LastRefill = now
+}
+
+// backoff prunes failures older than lockDuration and returns how much
+// longer the caller must wait given the most recent one, applying
+// 1s, 2s, 4s, ... doubling capped at lockDuration.
+func (l *LoginLimiter) backoff(s *loginBucketState) time.Duration {
+	now := time.Now().UTC()
+	cutoff := now.Add(-l.lockDuration)
+	recent := s.Failures[:0]
+	for _, f := range s.Failures {
+		if f.After(cutoff) {
+			recent = append(recent, f)
+		}
+	}
+	s.Failures = recent
+	if len(recent) == 0 {
+		return 0
+	}
+	// Cap the shift exponent: time.Second << 63 and beyond overflows
+	// time.Duration's int64 into a negative number, which would let
+	// backoff return 0 and disable the lockout right when a large burst
+	// of failures should be backing off hardest.
+	shift := uint(len(recent) - 1)
+	const maxShift = 62
+	if shift > maxShift {
+		shift = maxShift
+	}
+	wait := time.Second << shift
+	if wait > l.lockDuration {
+		wait = l.lockDuration
+	}
+	remaining := wait - now.Sub(recent[len(recent)-1])
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// updateState loads, mutates and CAS-writes the bucket state for
+// (user, sourceIP), retrying on a lost race rather than silently dropping
+// the update the way the old IncreaseLoginAttempts did.
+func (l *LoginLimiter) updateState(user, sourceIP string, mutate func(*loginBucketState)) error {
+	bucket := loginLimiterPath(user)
+	for i := 0; i < maxLimiterCASRetries; i++ {
+		prevData, _, err := l.backend.GetValAndTTL(bucket, sourceIP)
+		notFound := trace.IsNotFound(err)
+		if err != nil && !notFound {
+			return trace.Wrap(err)
+		}
+
+		var state loginBucketState
+		if !notFound {
+			if err := json.Unmarshal(prevData, &state); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+		l.refill(&state)
+		mutate(&state)
+
+		newData, err := json.Marshal(state)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		if notFound {
+			err = l.backend.CreateVal(bucket, sourceIP, newData, l.lockDuration)
+		} else {
+			_, err = l.backend.CompareAndSwap(bucket, sourceIP, newData, l.lockDuration, prevData)
+		}
+		if err == nil {
+			return nil
+		}
+		if trace.IsAlreadyExists(err) || trace.IsCompareFailed(err) {
+			continue // another goroutine updated the bucket concurrently, retry
+		}
+		return trace.Wrap(err)
+	}
+	return trace.LimitExceeded("too many concurrent login attempts for %q, try again", user)
+}
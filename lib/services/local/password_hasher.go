@@ -0,0 +1,237 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher hashes and verifies passwords, encoding everything needed
+// to verify a hash later (algorithm, cost parameters, salt) into a single
+// self-describing PHC-style envelope string, e.g.
+// "$argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>". This lets the storage
+// format evolve, and lets CheckPasswordWOToken recognize and transparently
+// upgrade hashes written under an older, weaker policy.
+type PasswordHasher interface {
+	// Algorithm returns the identifier this hasher writes into its
+	// envelopes, e.g. "bcrypt", "scrypt" or "argon2id"
+	Algorithm() string
+	// Hash hashes password into a new envelope using this hasher's policy
+	Hash(password []byte) (string, error)
+	// Verify reports whether password matches the hash in envelope
+	Verify(password []byte, envelope string) (bool, error)
+	// Weaker reports whether envelope was produced with cost parameters
+	// weaker than this hasher's current policy
+	Weaker(envelope string) (bool, error)
+}
+
+// algorithmOf identifies the PasswordHasher that produced envelope, so the
+// right one can be selected out of a registry for verification
+func algorithmOf(envelope string) string {
+	switch {
+	case strings.HasPrefix(envelope, "$argon2id$"):
+		return "argon2id"
+	case strings.HasPrefix(envelope, "$scrypt$"):
+		return "scrypt"
+	case strings.HasPrefix(envelope, "$2a$"), strings.HasPrefix(envelope, "$2b$"), strings.HasPrefix(envelope, "$2y$"):
+		return "bcrypt"
+	default:
+		return ""
+	}
+}
+
+// bcryptHasher wraps golang.org/x/crypto/bcrypt. Its envelope is just the
+// bcrypt hash itself, which is already self-describing.
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a PasswordHasher backed by bcrypt at the given cost
+func NewBcryptHasher(cost int) PasswordHasher {
+	return &bcryptHasher{cost: cost}
+}
+
+func (h *bcryptHasher) Algorithm() string { return "bcrypt" }
+
+func (h *bcryptHasher) Hash(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, h.cost)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Verify(password []byte, envelope string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(envelope), password)
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return false, trace.Wrap(err)
+	}
+	return true, nil
+}
+
+func (h *bcryptHasher) Weaker(envelope string) (bool, error) {
+	cost, err := bcrypt.Cost([]byte(envelope))
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return cost < h.cost, nil
+}
+
+// scryptHasher wraps golang.org/x/crypto/scrypt
+type scryptHasher struct {
+	logN, r, p, keyLen, saltLen int
+}
+
+// NewScryptHasher returns a PasswordHasher backed by scrypt with reasonable
+// interactive-login cost parameters (N=2^15, r=8, p=1)
+func NewScryptHasher() PasswordHasher {
+	return &scryptHasher{logN: 15, r: 8, p: 1, keyLen: 32, saltLen: 16}
+}
+
+func (h *scryptHasher) Algorithm() string { return "scrypt" }
+
+func (h *scryptHasher) Hash(password []byte) (string, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", trace.Wrap(err)
+	}
+	hash, err := scrypt.Key(password, salt, 1<<uint(h.logN), h.r, h.p, h.keyLen)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.logN, h.r, h.p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func (h *scryptHasher) parse(envelope string) (logN, r, p int, salt, hash []byte, err error) {
+	parts := strings.Split(envelope, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return 0, 0, 0, nil, nil, trace.BadParameter("not a scrypt envelope")
+	}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	if hash, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	return logN, r, p, salt, hash, nil
+}
+
+func (h *scryptHasher) Verify(password []byte, envelope string) (bool, error) {
+	logN, r, p, salt, hash, err := h.parse(envelope)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	computed, err := scrypt.Key(password, salt, 1<<uint(logN), r, p, len(hash))
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return subtle.ConstantTimeCompare(computed, hash) == 1, nil
+}
+
+func (h *scryptHasher) Weaker(envelope string) (bool, error) {
+	logN, r, p, _, _, err := h.parse(envelope)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return logN < h.logN || r < h.r || p < h.p, nil
+}
+
+// argon2idHasher wraps golang.org/x/crypto/argon2's Argon2id variant
+type argon2idHasher struct {
+	time, memory uint32
+	threads      uint8
+	keyLen       uint32
+	saltLen      int
+}
+
+// NewArgon2idHasher returns a PasswordHasher backed by Argon2id using this
+// package's default policy: 1 iteration, 64 MiB memory, 4 lanes, a 32-byte
+// tag and a 16-byte salt. This is IdentityService's default hasher for new
+// passwords.
+func NewArgon2idHasher() PasswordHasher {
+	return &argon2idHasher{time: 1, memory: 64 * 1024, threads: 4, keyLen: 32, saltLen: 16}
+}
+
+func (h *argon2idHasher) Algorithm() string { return "argon2id" }
+
+func (h *argon2idHasher) Hash(password []byte) (string, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", trace.Wrap(err)
+	}
+	hash := argon2.IDKey(password, salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func (h *argon2idHasher) parse(envelope string) (version int, memory, time uint32, threads uint8, salt, hash []byte, err error) {
+	parts := strings.Split(envelope, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return 0, 0, 0, 0, nil, nil, trace.BadParameter("not an argon2id envelope")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return 0, 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	var m, t, p uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return 0, 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return 0, 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	if hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return 0, 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	return version, m, t, uint8(p), salt, hash, nil
+}
+
+func (h *argon2idHasher) Verify(password []byte, envelope string) (bool, error) {
+	_, memory, time, threads, salt, hash, err := h.parse(envelope)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	computed := argon2.IDKey(password, salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(computed, hash) == 1, nil
+}
+
+func (h *argon2idHasher) Weaker(envelope string) (bool, error) {
+	_, memory, time, threads, _, _, err := h.parse(envelope)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return memory < h.memory || time < h.time || threads < h.threads, nil
+}
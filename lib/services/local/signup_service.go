@@ -0,0 +1,235 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/trace"
+)
+
+// Audit event types emitted by SignupService
+const (
+	SignupTokenEventIssued        = "signup.token.issued"
+	SignupTokenEventConsumed      = "signup.token.consumed"
+	SignupTokenEventConsumeFailed = "signup.token.consume_failed"
+	SignupTokenEventExpired       = "signup.token.expired"
+)
+
+// signupTokenLength is the size, in bytes, of a signup token before hex
+// encoding
+const signupTokenLength = 32
+
+// Notifier delivers an invite URL to its destination, e.g. email or chat
+type Notifier interface {
+	Notify(to string, inviteURL string) error
+}
+
+// SMTPNotifier delivers invites as plain text email over SMTP
+type SMTPNotifier struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// Notify emails inviteURL to the invitee
+func (n *SMTPNotifier) Notify(to string, inviteURL string) error {
+	msg := fmt.Sprintf("To: %v\r\nSubject: You've been invited to Teleport\r\n\r\n"+
+		"Follow this link to create your account: %v\r\n", to, inviteURL)
+	return trace.Wrap(smtp.SendMail(n.Addr, n.Auth, n.From, []string{to}, []byte(msg)))
+}
+
+// WebhookNotifier posts the invite URL as JSON to an HTTP endpoint, letting
+// teams wire invites into Slack, a ticket queue, or anything else that
+// accepts a webhook
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify posts {"to": to, "invite_url": inviteURL} to n.URL
+func (n *WebhookNotifier) Notify(to string, inviteURL string) error {
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	body, err := json.Marshal(struct {
+		To        string `json:"to"`
+		InviteURL string `json:"invite_url"`
+	}{To: to, InviteURL: inviteURL})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return trace.BadParameter("webhook notifier got status %v from %v", resp.StatusCode, n.URL)
+	}
+	return nil
+}
+
+// SignupService turns IdentityService's storage-only signup token
+// primitives (UpsertSignupToken/GetSignupToken/DeleteSignupToken) into a
+// real invite workflow: tokens are single-use, delivered by a pluggable
+// Notifier, audited, and listed a page at a time instead of scanned in full.
+type SignupService struct {
+	identity *IdentityService
+	notifier Notifier
+	emitter  events.Log
+}
+
+// NewSignupService returns a SignupService built on top of identity.
+// emitter may be nil, in which case audit events are simply not emitted.
+func NewSignupService(identity *IdentityService, notifier Notifier, emitter events.Log) *SignupService {
+	return &SignupService{
+		identity: identity,
+		notifier: notifier,
+		emitter:  emitter,
+	}
+}
+
+// IssueSignupToken generates a single-use invite token, stores tokenData
+// under it, and delivers the invite URL to inviteeEmail via the configured
+// Notifier. admin identifies who requested the invite, for the audit trail.
+func (s *SignupService) IssueSignupToken(admin, inviteeEmail string, tokenData services.SignupToken, ttl time.Duration) (token string, err error) {
+	token, err = generateSignupToken()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if err := s.identity.UpsertSignupToken(token, tokenData, ttl); err != nil {
+		return "", trace.Wrap(err)
+	}
+	inviteURL := fmt.Sprintf("/web/newuser/%v", token)
+	if err := s.notifier.Notify(inviteeEmail, inviteURL); err != nil {
+		s.emitAudit(SignupTokenEventIssued, admin, inviteeEmail, token, err)
+		// Delivery failed, so don't leave a live, undelivered invite behind
+		// for someone to stumble onto later.
+		if delErr := s.identity.DeleteSignupToken(token); delErr != nil && !trace.IsNotFound(delErr) {
+			log.Warningf("failed to roll back undelivered signup token: %v", delErr)
+		}
+		return "", trace.Wrap(err)
+	}
+	s.emitAudit(SignupTokenEventIssued, admin, inviteeEmail, token, nil)
+	return token, nil
+}
+
+// ConsumeSignupToken atomically consumes token, returning the data it was
+// issued with. The compare-and-swap against the raw stored bytes means that
+// if two requests race to use the same invite, exactly one succeeds and the
+// other gets a CompareFailed error rather than both getting in.
+func (s *SignupService) ConsumeSignupToken(token string) (*services.SignupToken, error) {
+	raw, err := s.identity.backend.GetVal(userTokensPath, token)
+	if err != nil {
+		if trace.IsNotFound(err) {
+			s.emitAudit(SignupTokenEventExpired, "", "", token, err)
+		} else {
+			s.emitAudit(SignupTokenEventConsumeFailed, "", "", token, err)
+		}
+		return nil, trace.Wrap(err)
+	}
+	var data services.SignupToken
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if _, err := s.identity.backend.CompareAndSwap(userTokensPath, token, []byte("consumed"), time.Second, raw); err != nil {
+		s.emitAudit(SignupTokenEventConsumeFailed, "", data.User, token, err)
+		return nil, trace.Wrap(err)
+	}
+	if err := s.identity.backend.DeleteKey(userTokensPath, token); err != nil && !trace.IsNotFound(err) {
+		return nil, trace.Wrap(err)
+	}
+	s.emitAudit(SignupTokenEventConsumed, "", data.User, token, nil)
+	return &data, nil
+}
+
+// ListSignupTokens returns up to limit outstanding signup tokens in key
+// order, starting after startKey, plus the startKey to pass in to fetch the
+// next page (empty once the list is exhausted), for admin UIs that only
+// need to show one page of invites at a time.
+func (s *SignupService) ListSignupTokens(startKey string, limit int) (tokens []services.SignupToken, nextKey string, err error) {
+	if limit <= 0 {
+		return nil, "", trace.BadParameter("limit must be positive, got %v", limit)
+	}
+	keys, err := s.identity.backend.GetKeys(userTokensPath)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	sort.Strings(keys)
+	i := sort.SearchStrings(keys, startKey)
+	if i < len(keys) && keys[i] == startKey {
+		i++
+	}
+	for ; i < len(keys) && len(tokens) < limit; i++ {
+		token, err := s.identity.GetSignupToken(keys[i])
+		if err != nil {
+			log.Warningf("skipping unreadable signup token %q: %v", keys[i], err)
+			continue
+		}
+		tokens = append(tokens, *token)
+	}
+	if i < len(keys) {
+		nextKey = keys[i-1]
+	}
+	return tokens, nextKey, nil
+}
+
+// generateSignupToken returns a cryptographically random, hex-encoded token
+func generateSignupToken() (string, error) {
+	b := make([]byte, signupTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// emitAudit records a signup token lifecycle event. It never logs the token
+// itself, only a short fingerprint, so an audit record can't be replayed as
+// a still-valid invite.
+func (s *SignupService) emitAudit(event, admin, user, token string, cause error) {
+	if s.emitter == nil {
+		return
+	}
+	fields := events.EventFields{
+		"admin":             admin,
+		"user":              user,
+		"token_fingerprint": tokenFingerprint(token),
+	}
+	if cause != nil {
+		fields["error"] = cause.Error()
+	}
+	s.emitter.EmitAuditEvent(event, fields)
+}
+
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
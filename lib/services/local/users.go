@@ -17,14 +17,19 @@ limitations under the License.
 package local
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image/png"
+	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/gravitational/teleport/lib/backend"
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/services"
@@ -32,30 +37,89 @@ import (
 	"github.com/gokyle/hotp"
 	"github.com/gravitational/configure/cstrings"
 	"github.com/gravitational/trace"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/tstranex/u2f"
 )
 
+// MFA method identifiers stored on a user via services.User.SetMFAMethod and
+// read back via services.User.GetMFAMethod. HOTP remains the default for
+// existing accounts until they complete the TOTP migration flow below.
+const (
+	MFAMethodHOTP = "hotp"
+	MFAMethodTOTP = "totp"
+	MFAMethodU2F  = "u2f"
+)
+
 // IdentityService is responsible for managing web users and currently
 // user accounts as well
 type IdentityService struct {
 	backend      backend.Backend
 	lockAfter    byte
 	lockDuration time.Duration
+	// hasher is used to hash newly set passwords
+	hasher PasswordHasher
+	// hashers holds every algorithm CheckPasswordWOToken can verify
+	// against, keyed by PasswordHasher.Algorithm(), so a stored hash never
+	// becomes unreadable just because hasher's policy moved on
+	hashers map[string]PasswordHasher
+}
+
+// IdentityServiceOption configures an IdentityService at construction time
+type IdentityServiceOption func(*IdentityService)
+
+// WithPasswordHasher overrides the default Argon2id password hashing policy,
+// letting operators tune memory/time cost (or switch algorithm entirely)
+// without a code change. The previous default remains registered for
+// verification so existing hashes keep working.
+func WithPasswordHasher(hasher PasswordHasher) IdentityServiceOption {
+	return func(s *IdentityService) {
+		s.hasher = hasher
+		s.hashers[hasher.Algorithm()] = hasher
+	}
 }
 
+// minLockAfter and minLockDuration are the smallest values NewIdentityService
+// will accept for lockAfter/lockDuration. Either being zero would brick or
+// disable the login rate limiter built from them (see LoginLimiter): a zero
+// lockAfter makes LoginLimiter.Allow reject every attempt, and a zero
+// lockDuration divides by zero when computing the token refill rate.
+const (
+	minLockAfter    = 1
+	minLockDuration = time.Minute
+)
+
 // NewIdentityService returns a new instance of IdentityService object
 func NewIdentityService(
 	backend backend.Backend,
 	lockAfter byte,
-	lockDuration time.Duration) *IdentityService {
+	lockDuration time.Duration,
+	opts ...IdentityServiceOption) *IdentityService {
+
+	if lockAfter < minLockAfter {
+		lockAfter = minLockAfter
+	}
+	if lockDuration < minLockDuration {
+		lockDuration = minLockDuration
+	}
 
-	return &IdentityService{
+	s := &IdentityService{
 		backend:      backend,
 		lockAfter:    lockAfter,
 		lockDuration: lockDuration,
+		hasher:       NewArgon2idHasher(),
+		hashers: map[string]PasswordHasher{
+			"bcrypt":   NewBcryptHasher(bcrypt.DefaultCost),
+			"scrypt":   NewScryptHasher(),
+			"argon2id": NewArgon2idHasher(),
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // GetUsers returns a list of users registered with the local auth server
@@ -120,9 +184,10 @@ func (s *IdentityService) GetUser(user string) (services.User, error) {
 	return &u, nil
 }
 
-// GetUserByOIDCIdentity returns a user by it's specified OIDC Identity, returns first
-// user specified with this identity
-func (s *IdentityService) GetUserByOIDCIdentity(id services.OIDCIdentity) (services.User, error) {
+// GetUserByExternalIdentity returns a user by their external identity
+// (OIDC, OAuth2/GitHub, ...), returning the first user found with a
+// matching identity.
+func (s *IdentityService) GetUserByExternalIdentity(id services.ExternalIdentity) (services.User, error) {
 	users, err := s.GetUsers()
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -200,88 +265,137 @@ func (s *IdentityService) GetHOTP(user string) (*hotp.HOTP, error) {
 	return otp, nil
 }
 
-// UpsertWebSession updates or inserts a web session for a user and session id
-func (s *IdentityService) UpsertWebSession(user, sid string, session services.WebSession, ttl time.Duration) error {
-	bytes, err := json.Marshal(session)
+// UpsertTOTP upserts TOTP secret key for user
+func (s *IdentityService) UpsertTOTP(user string, secret string) error {
+	err := s.backend.UpsertVal([]string{"web", "users", user}, "totp", []byte(secret), backend.Forever)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	err = s.backend.UpsertVal([]string{"web", "users", user, "sessions"},
-		sid, bytes, ttl)
-	if trace.IsNotFound(err) {
-		return trace.NotFound("user '%v' is not found", user)
+	return nil
+}
+
+// GetTOTP gets the TOTP secret key for a user
+func (s *IdentityService) GetTOTP(user string) (string, error) {
+	bytes, err := s.backend.GetVal([]string{"web", "users", user}, "totp")
+	if err != nil {
+		if trace.IsNotFound(err) {
+			return "", trace.NotFound("user '%v' is not found", user)
+		}
+		return "", trace.Wrap(err)
 	}
-	return trace.Wrap(err)
+	return string(bytes), nil
 }
 
-// IncreaseLoginAttempts bumps "login attempt" counter for the given user. If the counter
-// reaches 'lockAfter' value, it locks the account and returns access denied error.
-func (s *IdentityService) IncreaseLoginAttempts(user string) error {
-	bucket := []string{"web", "users", user}
+// EnrollTOTP generates and stores a new RFC 6238 TOTP secret (30 second
+// step, 6 digits, SHA-1) for user, returning an otpauth:// URL and a QR code
+// image so it can be scanned into an authenticator app. This is the first
+// step of the HOTP -> TOTP migration: the user's MFAMethod is not switched
+// until the generated code is verified by ConfirmTOTPEnrollment.
+func (s *IdentityService) EnrollTOTP(user string) (totpURL string, totpQR []byte, err error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "Teleport",
+		AccountName: user,
+		Period:      30,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return "", nil, trace.Wrap(err)
+	}
+	if err := s.UpsertTOTP(user, key.Secret()); err != nil {
+		return "", nil, trace.Wrap(err)
+	}
+	img, err := key.Image(defaults.QRImageWidth, defaults.QRImageWidth)
+	if err != nil {
+		return "", nil, trace.Wrap(err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", nil, trace.Wrap(err)
+	}
+	return key.String(), buf.Bytes(), nil
+}
 
-	data, _, err := s.backend.GetValAndTTL(bucket, "lock")
-	// unexpected error?
-	if err != nil && !trace.IsNotFound(err) {
+// ConfirmTOTPEnrollment validates token against the secret stored by
+// EnrollTOTP and, on success, switches user over to TOTP as their MFAMethod.
+func (s *IdentityService) ConfirmTOTPEnrollment(user string, token string) error {
+	if err := s.checkTOTP(user, token); err != nil {
 		return trace.Wrap(err)
 	}
-	// bump the attempt count
-	if len(data) < 1 {
-		data = []byte{0}
-	}
-	// check the attempt count
-	if len(data) > 0 && data[0] >= s.lockAfter {
-		return trace.AccessDenied("this account has been locked for %v", s.lockDuration)
-	}
-	newData := []byte{data[0] + 1}
-	// "create val" will create a new login attempt counter, or it will
-	// do nothing if it's already there.
-	//
-	// "compare and swap" will bump the counter +1
-	fmt.Printf("here; %#v %#v\n", data, newData)
-	s.backend.CreateVal(bucket, "lock", data, s.lockDuration)
-	newdata, _, err := s.backend.GetValAndTTL(bucket, "lock")
-	fmt.Printf("after create: %#v\n", newdata)
-	_, err = s.backend.CompareAndSwap(bucket, "lock", newData, s.lockDuration, data)
-	fmt.Printf("here; %#v %#v %v\n", data, newData, err)
-	return trace.Wrap(err)
+	u, err := s.GetUser(user)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	u.SetMFAMethod(MFAMethodTOTP)
+	return trace.Wrap(s.UpsertUser(u))
 }
 
-// IncreaseLoginAttempts bumps "login attempt" counter for the given user. If the counter
-// reaches 'lockAfter' value, it locks the account and returns access denied error.
-func (s *IdentityService) IncreaseLoginAttempts2(user string) error {
+// ResetMFA wipes all MFA state (HOTP, TOTP and U2F) for user and resets
+// MFAMethod back to the default, forcing re-enrollment on next login. This
+// is the admin-facing escape hatch for a user who has lost every factor.
+func (s *IdentityService) ResetMFA(user string) error {
 	bucket := []string{"web", "users", user}
-
-	data, _, err := s.backend.GetValAndTTL(bucket, "lock")
-	// unexpected error?
-	if err != nil && !trace.IsNotFound(err) {
+	for _, key := range []string{"hotp", "totp"} {
+		if err := s.backend.DeleteKey(bucket, key); err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+	}
+	if err := s.ClearU2F(user); err != nil {
 		return trace.Wrap(err)
 	}
-	newData := []byte{0}
-	copy(newData, data)
-	// check the attempt count
-	if newData[0] >= s.lockAfter {
-		return trace.AccessDenied("this account has been locked for %v", s.lockDuration)
+	u, err := s.GetUser(user)
+	if err != nil {
+		return trace.Wrap(err)
 	}
-	newData[0] += 1
-	// "create val" will create a new login attempt counter
-	if len(data) == 0 {
-		err = s.backend.CreateVal(bucket, "lock", newData, s.lockDuration)
+	u.SetMFAMethod(MFAMethodHOTP)
+	return trace.Wrap(s.UpsertUser(u))
+}
+
+// ClearU2F removes every U2F device registered to user (and their sign
+// counters), used by ResetMFA and when an admin revokes a lost security
+// key. This covers both the current multi-device layout and, for users who
+// haven't logged in since chunk0-4, the legacy single-key fields it
+// migrates from.
+func (s *IdentityService) ClearU2F(user string) error {
+	if err := s.backend.DeleteBucket([]string{"web", "users", user}, "u2f"); err != nil && !trace.IsNotFound(err) {
 		return trace.Wrap(err)
 	}
-	// we are going to increase the counter assuming the previous value has not changed
-	_, err = s.backend.CompareAndSwap(bucket, "lock", newData, s.lockDuration, data)
-	return trace.Wrap(err)
+	bucket := []string{"web", "users", user}
+	for _, key := range []string{"u2fregistration", "u2fregistrationcounter"} {
+		if err := s.backend.DeleteKey(bucket, key); err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
 }
 
-// ResetLoginAttempts resets the "login attempt" counter to zero.
-func (s *IdentityService) ResetLoginAttempts(user string) error {
-	err := s.backend.DeleteKey([]string{"web", "users", user}, "lock")
+// UpsertWebSession updates or inserts a web session for a user and session id
+func (s *IdentityService) UpsertWebSession(user, sid string, session services.WebSession, ttl time.Duration) error {
+	bytes, err := json.Marshal(session)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	err = s.backend.UpsertVal([]string{"web", "users", user, "sessions"},
+		sid, bytes, ttl)
 	if trace.IsNotFound(err) {
-		return nil
+		return trace.NotFound("user '%v' is not found", user)
 	}
 	return trace.Wrap(err)
 }
 
+// LoginLimiter returns the rate limiter used to throttle repeated failed
+// logins. It replaces the old fixed "N attempts then lock for D" counter,
+// which could never recover gracefully from a burst of failures and, in its
+// CAS-update path, silently dropped attempts it raced against.
+func (s *IdentityService) LoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		backend:      s.backend,
+		burst:        int(s.lockAfter),
+		refillPerSec: 1.0 / s.lockDuration.Seconds(),
+		lockDuration: s.lockDuration,
+	}
+}
+
 // GetWebSession returns a web session state for a given user and session id
 func (s *IdentityService) GetWebSession(user, sid string) (*services.WebSession, error) {
 	val, err := s.backend.GetVal(
@@ -317,7 +431,7 @@ func (s *IdentityService) UpsertPassword(user string,
 	if err := services.VerifyPassword(password); err != nil {
 		return "", nil, err
 	}
-	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	envelope, err := s.hasher.Hash(password)
 	if err != nil {
 		return "", nil, trace.Wrap(err)
 	}
@@ -335,7 +449,7 @@ func (s *IdentityService) UpsertPassword(user string,
 		return "", nil, trace.Wrap(err)
 	}
 
-	err = s.UpsertPasswordHash(user, hash)
+	err = s.UpsertPasswordHash(user, []byte(envelope))
 	if err != nil {
 		return "", nil, err
 	}
@@ -349,48 +463,127 @@ func (s *IdentityService) UpsertPassword(user string,
 }
 
 // CheckPassword is called on web user or tsh user login
-func (s *IdentityService) CheckPassword(user string, password []byte, hotpToken string) error {
-	hash, err := s.GetPasswordHash(user)
-	if err != nil {
+func (s *IdentityService) CheckPassword(user string, password []byte, token string, clientIP string) error {
+	limiter := s.LoginLimiter()
+	if wait, err := limiter.Allow(user, clientIP); err != nil {
 		return trace.Wrap(err)
+	} else if wait > 0 {
+		return trace.Wrap(&LoginAttemptLimitError{RetryAfter: wait})
 	}
-	if err = s.IncreaseLoginAttempts(user); err != nil {
+	if err := s.checkPasswordHash(user, password); err != nil {
+		limiter.RecordFailure(user, clientIP)
 		return trace.Wrap(err)
 	}
-	if err := bcrypt.CompareHashAndPassword(hash, password); err != nil {
-		return trace.AccessDenied("passwords do not match")
+	u, err := s.GetUser(user)
+	if err != nil {
+		return trace.Wrap(err)
 	}
+	switch u.GetMFAMethod() {
+	case MFAMethodTOTP:
+		if err := s.checkTOTP(user, token); err != nil {
+			limiter.RecordFailure(user, clientIP)
+			return trace.Wrap(err)
+		}
+	case MFAMethodU2F:
+		// U2F is a challenge-response protocol, not a token string: callers
+		// must drive it through CreateU2FSignChallenge/VerifyU2FSignResponse
+		// instead of CheckPassword. Reject rather than silently falling
+		// through to HOTP and asking the user for a token they don't have.
+		limiter.RecordFailure(user, clientIP)
+		return trace.BadParameter("user %q is enrolled in U2F; use the U2F sign challenge flow instead of CheckPassword", user)
+	default:
+		// everyone else is still on HOTP; offering the TOTP migration is
+		// the caller's responsibility once this returns successfully
+		if err := s.checkHOTP(user, token); err != nil {
+			limiter.RecordFailure(user, clientIP)
+			return trace.Wrap(err)
+		}
+	}
+	return trace.Wrap(limiter.RecordSuccess(user, clientIP))
+}
+
+// checkHOTP validates token against the user's HOTP counter, persisting the
+// advanced counter state on success
+func (s *IdentityService) checkHOTP(user, token string) error {
 	otp, err := s.GetHOTP(user)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	if !otp.Scan(hotpToken, defaults.HOTPFirstTokensRange) {
+	if !otp.Scan(token, defaults.HOTPFirstTokensRange) {
 		return trace.AccessDenied("bad one time token")
 	}
-	defer s.ResetLoginAttempts(user)
-	if err := s.UpsertHOTP(user, otp); err != nil {
+	return trace.Wrap(s.UpsertHOTP(user, otp))
+}
+
+// checkTOTP validates token against the user's stored TOTP secret, allowing
+// for up to one period of clock skew in either direction
+func (s *IdentityService) checkTOTP(user, token string) error {
+	secret, err := s.GetTOTP(user)
+	if err != nil {
 		return trace.Wrap(err)
 	}
+	valid, err := totp.ValidateCustom(token, secret, time.Now().UTC(), totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !valid {
+		return trace.AccessDenied("bad one time token")
+	}
 	return nil
 }
 
 // CheckPasswordWOToken checks just password without checking HOTP tokens
 // used in case of SSH authentication, when token has been validated
-func (s *IdentityService) CheckPasswordWOToken(user string, password []byte) error {
+func (s *IdentityService) CheckPasswordWOToken(user string, password []byte, clientIP string) error {
 	if err := services.VerifyPassword(password); err != nil {
 		return trace.Wrap(err)
 	}
+	limiter := s.LoginLimiter()
+	if wait, err := limiter.Allow(user, clientIP); err != nil {
+		return trace.Wrap(err)
+	} else if wait > 0 {
+		return trace.Wrap(&LoginAttemptLimitError{RetryAfter: wait})
+	}
+	if err := s.checkPasswordHash(user, password); err != nil {
+		limiter.RecordFailure(user, clientIP)
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(limiter.RecordSuccess(user, clientIP))
+}
+
+// checkPasswordHash verifies password against user's stored hash envelope
+// using whichever registered PasswordHasher produced it, then transparently
+// re-hashes and upserts it under the current policy if the stored envelope
+// was weaker than that policy (or written by a different algorithm
+// entirely) — a rolling upgrade with no separate migration step.
+func (s *IdentityService) checkPasswordHash(user string, password []byte) error {
 	hash, err := s.GetPasswordHash(user)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	if err = s.IncreaseLoginAttempts(user); err != nil {
+	envelope := string(hash)
+	hasher, ok := s.hashers[algorithmOf(envelope)]
+	if !ok {
+		return trace.BadParameter("user %q has a password hash in an unrecognized format", user)
+	}
+	valid, err := hasher.Verify(password, envelope)
+	if err != nil {
 		return trace.Wrap(err)
 	}
-	if err := bcrypt.CompareHashAndPassword(hash, password); err != nil {
-		return trace.BadParameter("passwords do not match")
+	if !valid {
+		return trace.AccessDenied("passwords do not match")
+	}
+	weaker, err := hasher.Weaker(envelope)
+	if err == nil && (weaker || hasher.Algorithm() != s.hasher.Algorithm()) {
+		if upgraded, err := s.hasher.Hash(password); err == nil {
+			s.UpsertPasswordHash(user, []byte(upgraded))
+		}
 	}
-	defer s.ResetLoginAttempts(user)
 	return nil
 }
 
@@ -434,22 +627,6 @@ func (s *IdentityService) GetSignupToken(token string) (*services.SignupToken, e
 	return data, nil
 }
 
-// GetSignupTokens returns all non-expired user tokens
-func (s *IdentityService) GetSignupTokens() (tokens []services.SignupToken, err error) {
-	keys, err := s.backend.GetKeys(userTokensPath)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-	for _, key := range keys {
-		token, err := s.GetSignupToken(key)
-		if err != nil {
-			log.Error(err)
-		}
-		tokens = append(tokens, *token)
-	}
-	return tokens, trace.Wrap(err)
-}
-
 // DeleteSignupToken deletes signup token from the storage
 func (s *IdentityService) DeleteSignupToken(token string) error {
 	err := s.backend.DeleteKey(userTokensPath, token)
@@ -490,94 +667,209 @@ type MarshallableU2FRegistration struct {
 	// AttestationCert is not needed for authentication so we don't need to store it
 }
 
-func (s *IdentityService) UpsertU2FRegistration(user string, u2fReg *u2f.Registration) error {
-	marshalledPubkey, err := x509.MarshalPKIXPublicKey(&u2fReg.PubKey)
+// unmarshalU2FRegistration turns a stored MarshallableU2FRegistration back
+// into the u2f.Registration the tstranex/u2f library operates on
+func unmarshalU2FRegistration(m MarshallableU2FRegistration) (*u2f.Registration, error) {
+	pubkeyInterface, err := x509.ParsePKIXPublicKey(m.MarshalledPubKey)
 	if err != nil {
-		return trace.Wrap(err)
+		return nil, trace.Wrap(err)
 	}
-
-	marshallableReg := MarshallableU2FRegistration{
-		Raw:              u2fReg.Raw,
-		KeyHandle:        u2fReg.KeyHandle,
-		MarshalledPubKey: marshalledPubkey,
+	pubkey, ok := pubkeyInterface.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, trace.Wrap(errors.New("failed to convert crypto.PublicKey back to ecdsa.PublicKey"))
 	}
+	return &u2f.Registration{
+		Raw:             m.Raw,
+		KeyHandle:       m.KeyHandle,
+		PubKey:          *pubkey,
+		AttestationCert: nil,
+	}, nil
+}
+
+// NamedU2FDevice is a single U2F security key registered to a user, as part
+// of a set: a user-facing friendly name so multiple keys can be told apart,
+// its key handle hash (the backend key it and its counter sibling are
+// stored under, and the value passed to DeleteU2FRegistration), and when it
+// was registered.
+type NamedU2FDevice struct {
+	Name          string                      `json:"name"`
+	KeyHandleHash string                      `json:"key_handle_hash"`
+	Registration  MarshallableU2FRegistration `json:"registration"`
+	CreatedAt     time.Time                   `json:"created_at"`
+}
+
+type U2FRegistrationCounter struct {
+	Counter uint32 `json:"counter"`
+}
+
+// u2fDevicesPath returns the bucket holding all of a user's registered U2F
+// devices, keyed by key handle hash, plus a "<hash>:counter" sibling per key
+func u2fDevicesPath(user string) []string {
+	return []string{"web", "users", user, "u2f"}
+}
+
+// u2fKeyHandleHash returns the backend key identifying a U2F registration,
+// derived from its key handle so it's stable across re-reads
+func u2fKeyHandleHash(keyHandle []byte) string {
+	sum := sha256.Sum256(keyHandle)
+	return hex.EncodeToString(sum[:])
+}
+
+func u2fCounterKey(keyHandleHash string) string {
+	return keyHandleHash + ":counter"
+}
 
-	data, err := json.Marshal(marshallableReg)
+// AddU2FRegistration adds a new named U2F registration for user without
+// disturbing any of their other registered keys, letting a user enroll a
+// backup security key.
+func (s *IdentityService) AddU2FRegistration(user, name string, u2fReg *u2f.Registration) error {
+	marshalledPubkey, err := x509.MarshalPKIXPublicKey(&u2fReg.PubKey)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-
-	err = s.backend.UpsertVal([]string{"web", "users", user}, "u2fregistration", data, backend.Forever)
+	device := NamedU2FDevice{
+		Name:          name,
+		KeyHandleHash: u2fKeyHandleHash(u2fReg.KeyHandle),
+		Registration: MarshallableU2FRegistration{
+			Raw:              u2fReg.Raw,
+			KeyHandle:        u2fReg.KeyHandle,
+			MarshalledPubKey: marshalledPubkey,
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(device)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	return nil
+	if err := s.backend.UpsertVal(u2fDevicesPath(user), device.KeyHandleHash, data, backend.Forever); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(s.UpsertU2FDeviceCounter(user, device.KeyHandleHash, 0))
 }
 
-func (s *IdentityService) GetU2FRegistration(user string) (*u2f.Registration, error) {
-	data, err := s.backend.GetVal([]string{"web", "users", user}, "u2fregistration")
-	if err != nil {
+// ListU2FRegistrations returns every U2F device registered to user, lazily
+// migrating a legacy single-key registration (from before multi-device
+// support) into the new per-key layout if one is found.
+func (s *IdentityService) ListU2FRegistrations(user string) ([]NamedU2FDevice, error) {
+	if err := s.migrateLegacyU2FRegistration(user); err != nil {
 		return nil, trace.Wrap(err)
 	}
-
-	marshallableReg := MarshallableU2FRegistration{}
-	err = json.Unmarshal(data, &marshallableReg)
+	keys, err := s.backend.GetKeys(u2fDevicesPath(user))
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-
-	pubkeyInterface, err := x509.ParsePKIXPublicKey(marshallableReg.MarshalledPubKey)
-	if err != nil {
-		return nil, trace.Wrap(err)
+	devices := make([]NamedU2FDevice, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":counter") {
+			continue
+		}
+		data, err := s.backend.GetVal(u2fDevicesPath(user), key)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		var device NamedU2FDevice
+		if err := json.Unmarshal(data, &device); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		devices = append(devices, device)
 	}
+	return devices, nil
+}
 
-	pubkey, ok := pubkeyInterface.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, trace.Wrap(errors.New("failed to convert crypto.PublicKey back to ecdsa.PublicKey"))
+// DeleteU2FRegistration removes a single U2F device (and its counter) from
+// user's set of registered keys, e.g. when a security key is lost.
+func (s *IdentityService) DeleteU2FRegistration(user, keyHandleHash string) error {
+	bucket := u2fDevicesPath(user)
+	if err := s.backend.DeleteKey(bucket, keyHandleHash); err != nil {
+		return trace.Wrap(err)
 	}
-
-	return &u2f.Registration{
-		Raw:             marshallableReg.Raw,
-		KeyHandle:       marshallableReg.KeyHandle,
-		PubKey:          *pubkey,
-		AttestationCert: nil,
-	}, nil
+	if err := s.backend.DeleteKey(bucket, u2fCounterKey(keyHandleHash)); err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	return nil
 }
 
-type U2FRegistrationCounter struct {
-	Counter uint32 `json:"counter"`
+// GetU2FDeviceCounter returns the current sign counter for a single
+// registered device, identified by its key handle hash
+func (s *IdentityService) GetU2FDeviceCounter(user, keyHandleHash string) (uint32, error) {
+	data, err := s.backend.GetVal(u2fDevicesPath(user), u2fCounterKey(keyHandleHash))
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	var c U2FRegistrationCounter
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, trace.Wrap(err)
+	}
+	return c.Counter, nil
 }
 
-func (s *IdentityService) UpsertU2FRegistrationCounter(user string, counter uint32) error {
-	data, err := json.Marshal(U2FRegistrationCounter{
-		Counter: counter,
-	})
+// UpsertU2FDeviceCounter advances the sign counter for a single registered
+// device after a successful sign verification
+func (s *IdentityService) UpsertU2FDeviceCounter(user, keyHandleHash string, counter uint32) error {
+	data, err := json.Marshal(U2FRegistrationCounter{Counter: counter})
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	err = s.backend.UpsertVal(u2fDevicesPath(user), u2fCounterKey(keyHandleHash), data, backend.Forever)
+	return trace.Wrap(err)
+}
 
-	err = s.backend.UpsertVal([]string{"web", "users", user}, "u2fregistrationcounter", data, backend.Forever)
+// migrateLegacyU2FRegistration moves a pre-multi-device single U2F
+// registration (stored directly under web/users/<user>) into the new
+// web/users/<user>/u2f/<keyHandleHash> layout, naming it "default". It is a
+// no-op if the user has no legacy registration.
+func (s *IdentityService) migrateLegacyU2FRegistration(user string) error {
+	bucket := []string{"web", "users", user}
+	data, err := s.backend.GetVal(bucket, "u2fregistration")
 	if err != nil {
+		if trace.IsNotFound(err) {
+			return nil
+		}
 		return trace.Wrap(err)
 	}
-	return nil
-}
-
-func (s *IdentityService) GetU2FRegistrationCounter(user string) (counter uint32, e error) {
-	data, err := s.backend.GetVal([]string{"web", "users", user}, "u2fregistrationcounter")
+	var marshallableReg MarshallableU2FRegistration
+	if err := json.Unmarshal(data, &marshallableReg); err != nil {
+		return trace.Wrap(err)
+	}
+	keyHandleHash := u2fKeyHandleHash(marshallableReg.KeyHandle)
+	device := NamedU2FDevice{
+		Name:          "default",
+		KeyHandleHash: keyHandleHash,
+		Registration:  marshallableReg,
+		CreatedAt:     time.Now().UTC(),
+	}
+	out, err := json.Marshal(device)
 	if err != nil {
-		return 0, trace.Wrap(err)
+		return trace.Wrap(err)
+	}
+	if err := s.backend.UpsertVal(u2fDevicesPath(user), keyHandleHash, out, backend.Forever); err != nil {
+		return trace.Wrap(err)
 	}
 
-	u2fRegCounter := U2FRegistrationCounter{}
-	err = json.Unmarshal(data, &u2fRegCounter)
-	if err != nil {
-		return 0, trace.Wrap(err)
+	counterData, err := s.backend.GetVal(bucket, "u2fregistrationcounter")
+	if err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	var counter U2FRegistrationCounter
+	if len(counterData) > 0 {
+		if err := json.Unmarshal(counterData, &counter); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if err := s.UpsertU2FDeviceCounter(user, keyHandleHash, counter.Counter); err != nil {
+		return trace.Wrap(err)
 	}
 
-	return u2fRegCounter.Counter, nil
+	if err := s.backend.DeleteKey(bucket, "u2fregistration"); err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	if err := s.backend.DeleteKey(bucket, "u2fregistrationcounter"); err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	return nil
 }
 
+// UpsertU2FSignChallenge stores the challenge issued for a sign request
 func (s *IdentityService) UpsertU2FSignChallenge(user string, u2fChallenge *u2f.Challenge) error {
 	data, err := json.Marshal(u2fChallenge)
 	if err != nil {
@@ -603,6 +895,70 @@ func (s *IdentityService) GetU2FSignChallenge(user string) (*u2f.Challenge, erro
 	return &u2fChal, nil
 }
 
+// CreateU2FSignChallenge issues a sign challenge covering every device
+// registered to user (via the challenge's RegisteredKeys), so the caller
+// can present a sign request that accepts any one of the user's security
+// keys rather than just the first one they ever registered.
+func (s *IdentityService) CreateU2FSignChallenge(user, appID string, trustedFacets []string) (*u2f.Challenge, error) {
+	devices, err := s.ListU2FRegistrations(user)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(devices) == 0 {
+		return nil, trace.NotFound("user %q has no registered U2F devices", user)
+	}
+	registrations := make([]u2f.Registration, len(devices))
+	for i, d := range devices {
+		reg, err := unmarshalU2FRegistration(d.Registration)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		registrations[i] = *reg
+	}
+	challenge, err := u2f.NewChallenge(appID, trustedFacets, registrations)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := s.UpsertU2FSignChallenge(user, challenge); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return challenge, nil
+}
+
+// VerifyU2FSignResponse validates resp against the outstanding sign
+// challenge for user, resolving which of the user's registered devices
+// produced it by key handle, and checks and advances that device's counter
+// so a captured response can't be replayed.
+func (s *IdentityService) VerifyU2FSignResponse(user string, resp *u2f.SignResponse) error {
+	challenge, err := s.GetU2FSignChallenge(user)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	devices, err := s.ListU2FRegistrations(user)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, d := range devices {
+		if base64.RawURLEncoding.EncodeToString(d.Registration.KeyHandle) != resp.KeyHandle {
+			continue
+		}
+		reg, err := unmarshalU2FRegistration(d.Registration)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		counter, err := s.GetU2FDeviceCounter(user, d.KeyHandleHash)
+		if err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		newCounter, err := reg.Authenticate(*resp, *challenge, counter)
+		if err != nil {
+			return trace.AccessDenied("U2F sign response did not verify: %v", err)
+		}
+		return trace.Wrap(s.UpsertU2FDeviceCounter(user, d.KeyHandleHash, newCounter))
+	}
+	return trace.AccessDenied("U2F sign response does not match any device registered to %q", user)
+}
+
 // UpsertOIDCConnector upserts OIDC Connector
 func (s *IdentityService) UpsertOIDCConnector(connector services.OIDCConnector, ttl time.Duration) error {
 	if err := connector.Check(); err != nil {
@@ -690,3 +1046,107 @@ func (s *IdentityService) GetOIDCAuthRequest(stateToken string) (*services.OIDCA
 	}
 	return req, nil
 }
+
+// oauth2ConnectorsPath returns the connectors bucket for a given OAuth2
+// provider type ("github", "bitbucket", "gitlab", ...), keeping connectors
+// for different providers from colliding on ID
+func oauth2ConnectorsPath(connectorType string) []string {
+	return []string{"web", "connectors", "oauth2", connectorType}
+}
+
+// oauth2AuthRequestsPath returns the auth requests bucket for a given
+// OAuth2 provider type
+func oauth2AuthRequestsPath(connectorType string) []string {
+	return []string{"web", "connectors", "oauth2", connectorType, "requests"}
+}
+
+// UpsertOAuth2Connector upserts an OAuth2 connector (e.g. GitHub, Bitbucket,
+// GitLab), used by teams that want SSO without running a full OIDC IdP
+func (s *IdentityService) UpsertOAuth2Connector(connector services.OAuth2Connector, ttl time.Duration) error {
+	if err := connector.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	data, err := json.Marshal(connector)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	err = s.backend.UpsertVal(oauth2ConnectorsPath(connector.Type), connector.ID, data, ttl)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// DeleteOAuth2Connector deletes an OAuth2 connector
+func (s *IdentityService) DeleteOAuth2Connector(connectorType, connectorID string) error {
+	err := s.backend.DeleteKey(oauth2ConnectorsPath(connectorType), connectorID)
+	return trace.Wrap(err)
+}
+
+// GetOAuth2Connector returns OAuth2 connector data, withSecrets adds or
+// removes the client secret from the return value
+func (s *IdentityService) GetOAuth2Connector(connectorType, id string, withSecrets bool) (*services.OAuth2Connector, error) {
+	out, err := s.backend.GetVal(oauth2ConnectorsPath(connectorType), id)
+	if err != nil {
+		if trace.IsNotFound(err) {
+			return nil, trace.NotFound("OAuth2 connector '%v' is not configured", id)
+		}
+		return nil, trace.Wrap(err)
+	}
+	var data *services.OAuth2Connector
+	err = json.Unmarshal(out, &data)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if !withSecrets {
+		data.ClientSecret = ""
+	}
+	return data, nil
+}
+
+// GetOAuth2Connectors returns registered OAuth2 connectors of the given
+// type, withSecrets adds or removes the client secret from the return value
+func (s *IdentityService) GetOAuth2Connectors(connectorType string, withSecrets bool) ([]services.OAuth2Connector, error) {
+	connectorIDs, err := s.backend.GetKeys(oauth2ConnectorsPath(connectorType))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	connectors := make([]services.OAuth2Connector, 0, len(connectorIDs))
+	for _, id := range connectorIDs {
+		connector, err := s.GetOAuth2Connector(connectorType, id, withSecrets)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		connectors = append(connectors, *connector)
+	}
+	return connectors, nil
+}
+
+// CreateOAuth2AuthRequest creates a new OAuth2 auth request
+func (s *IdentityService) CreateOAuth2AuthRequest(connectorType string, req services.OAuth2AuthRequest, ttl time.Duration) error {
+	if err := req.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	err = s.backend.CreateVal(oauth2AuthRequestsPath(connectorType), req.StateToken, data, ttl)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// GetOAuth2AuthRequest returns an OAuth2 auth request if found
+func (s *IdentityService) GetOAuth2AuthRequest(connectorType, stateToken string) (*services.OAuth2AuthRequest, error) {
+	data, err := s.backend.GetVal(oauth2AuthRequestsPath(connectorType), stateToken)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var req *services.OAuth2AuthRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return req, nil
+}